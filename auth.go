@@ -0,0 +1,70 @@
+package torOnion
+
+import "fmt"
+
+// AddClientAuth authorizes cred (a "username:credential" pair for a v2
+// BasicAuth service, or a client's base32 x25519 public key for a v3
+// service) to connect to the onion service identified by onionID. The
+// credential takes effect the next time that service's ADD_ONION is
+// (re)issued, which happens immediately if the service is already live.
+func (t *OnionTransport) AddClientAuth(onionID, cred string) error {
+	t.clientAuths[onionID] = append(t.clientAuths[onionID], cred)
+
+	svc, ok := t.services[onionID]
+	if !ok {
+		return nil
+	}
+	return t.refreshClientAuth(svc)
+}
+
+// AddOutboundAuth registers cookie as our credential for dialing the
+// authorized onion service onionID, installing it via
+// `SETCONF HidServAuth` so it's in effect before the next Dial.
+func (t *OnionTransport) AddOutboundAuth(onionID, cookie string) error {
+	t.hidServAuth[onionID] = cookie
+	cmd := fmt.Sprintf("SETCONF HidServAuth=\"%s.onion %s\"", onionID, cookie)
+	_, err := t.controlConn.Request("%s", cmd)
+	return err
+}
+
+// clientAuthArgs renders the ClientAuth/ClientAuthV3 ADD_ONION
+// arguments authorizing every credential registered for id.
+func (t *OnionTransport) clientAuthArgs(id string) []string {
+	creds := t.clientAuths[id]
+	if len(creds) == 0 {
+		return nil
+	}
+	keyword := "ClientAuth="
+	if len(id) == 56 {
+		keyword = "ClientAuthV3="
+	}
+	args := make([]string, 0, len(creds))
+	for _, cred := range creds {
+		args = append(args, keyword+cred)
+	}
+	return args
+}
+
+// refreshClientAuth re-issues ADD_ONION for an already-live service
+// using its existing ports, so newly added client-auth credentials take
+// effect without changing which ports it listens on.
+func (t *OnionTransport) refreshClientAuth(svc *onionService) error {
+	var flags []string
+	if t.nonAnonymous {
+		flags = append(flags, "NonAnonymous")
+	}
+	if _, err := t.controlConn.Request("DEL_ONION " + svc.id); err != nil {
+		return fmt.Errorf("failed to detach %s to refresh client auth: %v", svc.id, err)
+	}
+	resp, err := t.controlConn.Request("%s", addOnionCommand(svc.key, svc.ports, flags, t.maxStreams, t.clientAuthArgs(svc.id)))
+	if err != nil {
+		return err
+	}
+	serviceID, err := parseAddOnionServiceID(resp)
+	if err != nil {
+		return err
+	}
+	svc.id = serviceID
+	t.services[serviceID] = svc
+	return nil
+}
@@ -0,0 +1,26 @@
+package torOnion
+
+import "testing"
+
+func TestClientAuthArgs(t *testing.T) {
+	transport := &OnionTransport{clientAuths: map[string][]string{
+		"erhkddypoy6qml6h": {"alice:cookie1"},
+	}}
+	args := transport.clientAuthArgs("erhkddypoy6qml6h")
+	if len(args) != 1 || args[0] != "ClientAuth=alice:cookie1" {
+		t.Fatalf("expected a single v2 ClientAuth= argument, got %v", args)
+	}
+
+	transport = &OnionTransport{clientAuths: map[string][]string{
+		"uygr33nmhmtatvne7cldwcxsplx7t5cwmkxp3ehdzpufaow3thur4sid": {"x25519pubkey"},
+	}}
+	args = transport.clientAuthArgs("uygr33nmhmtatvne7cldwcxsplx7t5cwmkxp3ehdzpufaow3thur4sid")
+	if len(args) != 1 || args[0] != "ClientAuthV3=x25519pubkey" {
+		t.Fatalf("expected a single v3 ClientAuthV3= argument, got %v", args)
+	}
+
+	transport = &OnionTransport{clientAuths: map[string][]string{}}
+	if args := transport.clientAuthArgs("nothing-registered"); args != nil {
+		t.Fatalf("expected no args for an onion ID with no registered credentials, got %v", args)
+	}
+}
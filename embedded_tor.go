@@ -0,0 +1,212 @@
+package torOnion
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	tptu "github.com/libp2p/go-libp2p-transport-upgrader"
+	"github.com/yawning/bulb"
+	"golang.org/x/net/proxy"
+)
+
+// minEphemeralPort and maxEphemeralPort bound the random ControlPort and
+// SocksPort we pick for an embedded tor instance.
+const (
+	minEphemeralPort = 20000
+	maxEphemeralPort = 60000
+)
+
+// Creator starts a tor process rooted at dataDir using the torrc at
+// torrcPath, and returns once the process has been launched (not once
+// it has bootstrapped). The returned *exec.Cmd must be the one Start
+// was called on, so its owner can Wait() on it and avoid leaving a
+// zombie process behind. Implement this to plug in a library-embedded
+// tor, such as berty/go-libtor, instead of shelling out to a binary.
+type Creator interface {
+	Start(dataDir, torrcPath string) (*exec.Cmd, error)
+}
+
+// ExecCreator is the default Creator: it shells out to a tor binary on
+// disk or on PATH.
+type ExecCreator struct {
+	// TorPath is the path to the tor binary. "tor" (resolved via PATH)
+	// is used when empty.
+	TorPath string
+}
+
+// Start implements Creator.
+func (c ExecCreator) Start(dataDir, torrcPath string) (*exec.Cmd, error) {
+	torPath := c.TorPath
+	if torPath == "" {
+		torPath = "tor"
+	}
+	cmd := exec.Command(torPath, "-f", torrcPath)
+	cmd.Dir = dataDir
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start tor: %v", err)
+	}
+	return cmd, nil
+}
+
+// EmbeddedTorConfig controls how StartEmbeddedTor brings tor up.
+type EmbeddedTorConfig struct {
+	// Creator launches the tor process. Defaults to ExecCreator{} when nil.
+	Creator Creator
+	// DataDir is the directory tor will use for its state and torrc; the
+	// control and SOCKS ports are TCP ports on 127.0.0.1, not sockets in
+	// this directory. A temporary directory is created and removed
+	// on Close when DataDir is empty.
+	DataDir string
+	// BootstrapTimeout bounds how long StartEmbeddedTor waits for tor to
+	// reach 100% bootstrap. Defaults to 2 minutes when zero.
+	BootstrapTimeout time.Duration
+}
+
+// EmbeddedTor is a tor process this package started and owns. Callers
+// that would rather run tor themselves should use NewOnionTransport with
+// an external control port instead.
+type EmbeddedTor struct {
+	DataDir     string
+	ControlPort int
+	SocksPort   int
+
+	cmd     *exec.Cmd
+	ownsDir bool
+}
+
+// Close kills the managed tor process, waits for it to exit so it
+// doesn't linger as a zombie, and, if StartEmbeddedTor created DataDir
+// itself, removes it.
+func (e *EmbeddedTor) Close() error {
+	if e.cmd != nil && e.cmd.Process != nil {
+		e.cmd.Process.Kill()
+		e.cmd.Wait()
+	}
+	if e.ownsDir {
+		return os.RemoveAll(e.DataDir)
+	}
+	return nil
+}
+
+// StartEmbeddedTor launches a managed tor process, waits for it to
+// bootstrap, and returns a fully-wired OnionTransport backed by it along
+// with the EmbeddedTor handle used to shut tor back down.
+//
+// This is the single-binary alternative to NewOnionTransport: it avoids
+// requiring operators to run and configure a separate tor daemon.
+func StartEmbeddedTor(cfg EmbeddedTorConfig, auth *proxy.Auth, keysDir string, upgrader *tptu.Upgrader, onlyOnion bool, keyType KeyType) (*OnionTransport, *EmbeddedTor, error) {
+	creator := cfg.Creator
+	if creator == nil {
+		creator = ExecCreator{}
+	}
+	bootstrapTimeout := cfg.BootstrapTimeout
+	if bootstrapTimeout == 0 {
+		bootstrapTimeout = 2 * time.Minute
+	}
+
+	dataDir := cfg.DataDir
+	ownsDir := false
+	if dataDir == "" {
+		var err error
+		dataDir, err = ioutil.TempDir("", "go-onion-transport")
+		if err != nil {
+			return nil, nil, err
+		}
+		ownsDir = true
+	}
+
+	controlPort := randomEphemeralPort()
+	socksPort := randomEphemeralPort()
+	for socksPort == controlPort {
+		socksPort = randomEphemeralPort()
+	}
+	torrcPath := filepath.Join(dataDir, "torrc")
+	torrc := fmt.Sprintf(
+		"DataDirectory %s\nControlPort %d\nSocksPort %d\nCookieAuthentication 1\n",
+		dataDir, controlPort, socksPort,
+	)
+	if err := ioutil.WriteFile(torrcPath, []byte(torrc), 0600); err != nil {
+		return nil, nil, err
+	}
+
+	cmd, err := creator.Start(dataDir, torrcPath)
+	if err != nil {
+		if ownsDir {
+			os.RemoveAll(dataDir)
+		}
+		return nil, nil, err
+	}
+
+	e := &EmbeddedTor{
+		DataDir:     dataDir,
+		ControlPort: controlPort,
+		SocksPort:   socksPort,
+		cmd:         cmd,
+		ownsDir:     ownsDir,
+	}
+
+	controlAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(controlPort))
+	if err := waitForBootstrap(controlAddr, bootstrapTimeout); err != nil {
+		e.Close()
+		return nil, nil, err
+	}
+
+	t, err := NewOnionTransport("tcp", controlAddr, "", auth, keysDir, upgrader, onlyOnion, keyType, false, 0)
+	if err != nil {
+		e.Close()
+		return nil, nil, err
+	}
+
+	return t, e, nil
+}
+
+// waitForBootstrap polls GETINFO status/bootstrap-phase on a fresh
+// control connection to controlAddr until tor reports PROGRESS=100, or
+// returns an error once timeout elapses.
+func waitForBootstrap(controlAddr string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	var lastErr error
+	for time.Now().Before(deadline) {
+		conn, err := bulb.Dial("tcp", controlAddr)
+		if err != nil {
+			lastErr = err
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		if err := conn.Authenticate(""); err != nil {
+			conn.Close()
+			lastErr = err
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		resp, err := conn.Request("GETINFO status/bootstrap-phase")
+		conn.Close()
+		if err != nil {
+			lastErr = err
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		reply := fmt.Sprintf("%v", resp)
+		if strings.Contains(reply, "PROGRESS=100") {
+			return nil
+		}
+		lastErr = fmt.Errorf("tor not yet bootstrapped: %s", reply)
+		time.Sleep(250 * time.Millisecond)
+	}
+	return fmt.Errorf("timed out waiting for tor to bootstrap: %v", lastErr)
+}
+
+// randomEphemeralPort returns a random port in our ephemeral range,
+// used to pick a ControlPort/SocksPort. It does not check that the port
+// is free, so a collision with another process is unlikely, not ruled out.
+func randomEphemeralPort() int {
+	return minEphemeralPort + rand.Intn(maxEphemeralPort-minEphemeralPort)
+}
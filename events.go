@@ -0,0 +1,172 @@
+package torOnion
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/yawning/bulb"
+)
+
+// TorEvent is a single parsed Tor control-port async event, e.g. a CIRC
+// status change or an HS_DESC upload notification.
+type TorEvent struct {
+	// Type is the event keyword: CIRC, STREAM, HS_DESC, NEWCONSENSUS or BW.
+	Type string
+	// Data is the remainder of the event line after Type.
+	Data string
+}
+
+// StartEvents opens a second control connection, subscribes to circuit,
+// stream, descriptor, consensus and bandwidth events, and starts
+// delivering them on the channel returned by Events. It is a no-op if
+// events have already been started.
+func (t *OnionTransport) StartEvents() error {
+	if t.eventConn != nil {
+		return nil
+	}
+
+	conn, err := bulb.Dial(t.controlNet, t.controlAddr)
+	if err != nil {
+		return err
+	}
+	if err := conn.Authenticate(t.controlPass); err != nil {
+		conn.Close()
+		return fmt.Errorf("Authentication failed: %v", err)
+	}
+	if _, err := conn.Request("SETEVENTS CIRC STREAM HS_DESC NEWCONSENSUS BW"); err != nil {
+		conn.Close()
+		return err
+	}
+	conn.StartAsyncReader()
+
+	t.eventConn = conn
+	t.eventsCh = make(chan TorEvent, 64)
+	go t.pumpEvents(conn)
+	return nil
+}
+
+// pumpEvents reads async replies off conn via NextEvent, parses them
+// into TorEvents, and forwards them on t.eventsCh until conn is closed.
+func (t *OnionTransport) pumpEvents(conn *bulb.Conn) {
+	defer close(t.eventsCh)
+	for {
+		resp, err := conn.NextEvent()
+		if err != nil {
+			return
+		}
+		// a single-line "650 TYPE ..." event carries its text in Reply
+		raw := resp.Reply
+		if len(resp.Data) > 0 {
+			raw = resp.Data[0]
+		}
+		line := strings.TrimSpace(raw)
+		if line == "" {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		ev := TorEvent{Type: fields[0]}
+		if len(fields) > 1 {
+			ev.Data = fields[1]
+		}
+		select {
+		case t.eventsCh <- ev:
+		default:
+			// a slow consumer shouldn't stall Tor's control connection
+		}
+	}
+}
+
+// Events returns the channel events are delivered on. It is nil until
+// StartEvents has been called.
+func (t *OnionTransport) Events() <-chan TorEvent {
+	return t.eventsCh
+}
+
+// CircuitStatus returns Tor's current view of all circuits, one
+// TorEvent per circuit-status line. StartEvents must have been called
+// first, since it owns the connection this is issued over.
+func (t *OnionTransport) CircuitStatus() ([]TorEvent, error) {
+	if t.eventConn == nil {
+		return nil, fmt.Errorf("events not started: call StartEvents first")
+	}
+	resp, err := t.eventConn.Request("GETINFO circuit-status")
+	if err != nil {
+		return nil, err
+	}
+	var events []TorEvent
+	// the reply's data is a "circuit-status=" header followed by one
+	// dot-encoded block holding every circuit, one per line
+	for _, chunk := range resp.Data {
+		for _, line := range strings.Split(chunk, "\n") {
+			line = strings.TrimSpace(strings.TrimPrefix(line, "circuit-status="))
+			if line == "" {
+				continue
+			}
+			events = append(events, TorEvent{Type: "CIRC", Data: line})
+		}
+	}
+	return events, nil
+}
+
+// HSDescStatus returns Tor's reply to GETINFO hs/client/desc/id/<onionID>,
+// the descriptor Tor holds for that service, with the reply's lines
+// joined by newlines. It does not count HSDir uploads.
+func (t *OnionTransport) HSDescStatus(onionID string) (string, error) {
+	if t.eventConn == nil {
+		return "", fmt.Errorf("events not started: call StartEvents first")
+	}
+	resp, err := t.eventConn.Request(fmt.Sprintf("GETINFO hs/client/desc/id/%s", onionID))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(strings.Join(resp.Data, "\n")), nil
+}
+
+// Bootstrapped reports Tor's current bootstrap progress as a percentage
+// plus a human-readable summary, via GETINFO status/bootstrap-phase.
+func (t *OnionTransport) Bootstrapped() (percent int, summary string, err error) {
+	resp, err := t.controlConn.Request("GETINFO status/bootstrap-phase")
+	if err != nil {
+		return 0, "", err
+	}
+	line := strings.Join(resp.Data, " ")
+
+	percent = extractIntField(line, "PROGRESS=")
+	summary = extractQuotedField(line, "SUMMARY=")
+	return percent, summary, nil
+}
+
+// extractIntField returns the integer following key in s, or 0 if key
+// isn't present or isn't followed by a valid integer.
+func extractIntField(s, key string) int {
+	idx := strings.Index(s, key)
+	if idx < 0 {
+		return 0
+	}
+	rest := s[idx+len(key):]
+	end := strings.IndexAny(rest, " \r\n")
+	if end < 0 {
+		end = len(rest)
+	}
+	n, _ := strconv.Atoi(rest[:end])
+	return n
+}
+
+// extractQuotedField returns the double-quoted value following key in
+// s, or "" if key isn't present.
+func extractQuotedField(s, key string) string {
+	idx := strings.Index(s, key)
+	if idx < 0 {
+		return ""
+	}
+	rest := s[idx+len(key):]
+	if !strings.HasPrefix(rest, "\"") {
+		return ""
+	}
+	end := strings.Index(rest[1:], "\"")
+	if end < 0 {
+		return ""
+	}
+	return rest[1 : end+1]
+}
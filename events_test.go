@@ -0,0 +1,45 @@
+package torOnion
+
+import "testing"
+
+func TestExtractIntField(t *testing.T) {
+	cases := []struct {
+		name string
+		s    string
+		key  string
+		want int
+	}{
+		{"present", `250-status/bootstrap-phase=NOTICE BOOTSTRAP PROGRESS=42 TAG=handshake_dir SUMMARY="Handshaking with directory server"`, "PROGRESS=", 42},
+		{"trailing field", "PROGRESS=100 TAG=done", "PROGRESS=", 100},
+		{"missing key", "TAG=done", "PROGRESS=", 0},
+		{"non-numeric value", "PROGRESS=abc", "PROGRESS=", 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := extractIntField(c.s, c.key); got != c.want {
+				t.Fatalf("extractIntField(%q, %q) = %d, want %d", c.s, c.key, got, c.want)
+			}
+		})
+	}
+}
+
+func TestExtractQuotedField(t *testing.T) {
+	cases := []struct {
+		name string
+		s    string
+		key  string
+		want string
+	}{
+		{"present", `PROGRESS=42 TAG=handshake_dir SUMMARY="Handshaking with directory server"`, "SUMMARY=", "Handshaking with directory server"},
+		{"missing key", "PROGRESS=42", "SUMMARY=", ""},
+		{"unquoted value", "SUMMARY=oops", "SUMMARY=", ""},
+		{"unterminated quote", `SUMMARY="oops`, "SUMMARY=", ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := extractQuotedField(c.s, c.key); got != c.want {
+				t.Fatalf("extractQuotedField(%q, %q) = %q, want %q", c.s, c.key, got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+package torOnion
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	tpt "github.com/libp2p/go-libp2p-transport"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/yawning/bulb"
+	"github.com/yawning/bulb/utils/pkcs1"
+	"golang.org/x/crypto/ed25519"
+)
+
+// newOnionHost is the sentinel host an onion multiaddr uses to ask
+// Listen to generate a fresh onion service instead of loading one from
+// keysDir, e.g. "/onion/new:4003".
+const newOnionHost = "new"
+
+// generateAndListen issues `ADD_ONION NEW:...` for a brand-new key
+// (preferring t.keyType), persists the returned key material under
+// keysDir so a restart can stably re-listen on the same address, and
+// brings up port as that service's virtual port.
+func (t *OnionTransport) generateAndListen(port uint16, laddr ma.Multiaddr) (tpt.Listener, error) {
+	keyArg := "NEW:BEST"
+	if t.keyType == KeyTypeV3 {
+		keyArg = "NEW:ED25519-V3"
+	}
+
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	target := local.Addr().(*net.TCPAddr).Port
+	portArg := fmt.Sprintf("%d,127.0.0.1:%d", port, target)
+
+	var flags []string
+	if t.nonAnonymous {
+		flags = append(flags, "NonAnonymous")
+	}
+	resp, err := t.controlConn.Request("%s", addOnionCommand(keyArg, []string{portArg}, flags, t.maxStreams, nil))
+	if err != nil {
+		local.Close()
+		return nil, err
+	}
+
+	id, err := parseAddOnionServiceID(resp)
+	if err != nil {
+		local.Close()
+		return nil, err
+	}
+	privKeyArg, err := parseAddOnionPrivateKey(resp)
+	if err != nil {
+		local.Close()
+		return nil, err
+	}
+	if err := t.persistGeneratedKey(id, privKeyArg); err != nil {
+		local.Close()
+		return nil, err
+	}
+
+	t.services[id] = &onionService{id: id, key: privKeyArg, ports: []string{portArg}}
+
+	listener := OnionListener{port: port, laddr: laddr, listener: local}
+	if len(id) == 56 {
+		listener.isKeyV3 = true
+		listener.keyV3 = t.keysV3[id]
+	} else {
+		listener.key = t.keys[id]
+	}
+
+	return t.upgrader.UpgradeListener(t, listener), nil
+}
+
+// RotateKey replaces the key behind an active onion service with a
+// freshly generated one, preserving its virtual/target port mappings
+// and client-auth credentials, then tears down the old service and
+// removes its key file. This is useful when an operator suspects a key
+// has been compromised.
+func (t *OnionTransport) RotateKey(oldID string) (newID string, err error) {
+	svc, ok := t.services[oldID]
+	if !ok {
+		return "", fmt.Errorf("no active onion service for %s", oldID)
+	}
+
+	keyArg := "NEW:BEST"
+	if len(oldID) == 56 {
+		keyArg = "NEW:ED25519-V3"
+	}
+	var flags []string
+	if t.nonAnonymous {
+		flags = append(flags, "NonAnonymous")
+	}
+	resp, err := t.controlConn.Request("%s", addOnionCommand(keyArg, svc.ports, flags, t.maxStreams, t.clientAuthArgs(oldID)))
+	if err != nil {
+		return "", err
+	}
+	newID, err = parseAddOnionServiceID(resp)
+	if err != nil {
+		return "", err
+	}
+	privKeyArg, err := parseAddOnionPrivateKey(resp)
+	if err != nil {
+		return "", err
+	}
+	if err := t.persistGeneratedKey(newID, privKeyArg); err != nil {
+		return "", err
+	}
+
+	if _, err := t.controlConn.Request("DEL_ONION " + oldID); err != nil {
+		return newID, fmt.Errorf("generated new key %s but failed to retire old service %s: %v", newID, oldID, err)
+	}
+
+	t.services[newID] = &onionService{id: newID, key: privKeyArg, ports: svc.ports}
+	delete(t.services, oldID)
+	if creds, ok := t.clientAuths[oldID]; ok {
+		t.clientAuths[newID] = creds
+		delete(t.clientAuths, oldID)
+	}
+
+	if err := t.removeKeyFile(oldID); err != nil {
+		return newID, err
+	}
+	if len(oldID) == 56 {
+		delete(t.keysV3, oldID)
+	} else {
+		delete(t.keys, oldID)
+	}
+
+	return newID, nil
+}
+
+// persistGeneratedKey decodes the "TYPE:base64" PrivateKey= argument
+// Tor's ADD_ONION reply carries for a NEW key, loads it into the
+// appropriate in-memory key map, and writes it to keysDir under id so a
+// future restart can re-listen on the same address.
+func (t *OnionTransport) persistGeneratedKey(id, privKeyArg string) error {
+	parts := strings.SplitN(privKeyArg, ":", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("malformed PrivateKey argument: %s", privKeyArg)
+	}
+	keyBytes, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return fmt.Errorf("failed to decode generated key for %s: %v", id, err)
+	}
+
+	absPath, err := filepath.Abs(t.keysDir)
+	if err != nil {
+		return err
+	}
+
+	switch parts[0] {
+	case "RSA1024":
+		privKey, _, err := pkcs1.DecodePrivateKeyDER(keyBytes)
+		if err != nil {
+			return fmt.Errorf("failed to parse generated RSA key for %s: %v", id, err)
+		}
+		t.keys[id] = privKey
+		block := pem.Block{Type: "RSA PRIVATE KEY", Bytes: keyBytes}
+		return writeKeyFile(filepath.Join(absPath, id+".onion_key"), pem.EncodeToMemory(&block))
+	case "ED25519-V3":
+		if len(keyBytes) != ed25519.PrivateKeySize {
+			return fmt.Errorf("malformed generated ed25519 key for %s", id)
+		}
+		t.keysV3[id] = ed25519.PrivateKey(keyBytes)
+		block := pem.Block{Type: "ED25519 PRIVATE KEY", Bytes: keyBytes}
+		return writeKeyFile(filepath.Join(absPath, id+".onion_v3_key"), pem.EncodeToMemory(&block))
+	default:
+		return fmt.Errorf("unsupported generated key type %q for %s", parts[0], id)
+	}
+}
+
+// writeKeyFile writes data to path atomically: it writes to a sibling
+// temp file and renames it into place, so a crash mid-write can't leave
+// a truncated key file behind.
+func writeKeyFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// removeKeyFile removes whichever onion key file (v2 or v3) exists for
+// id in keysDir.
+func (t *OnionTransport) removeKeyFile(id string) error {
+	absPath, err := filepath.Abs(t.keysDir)
+	if err != nil {
+		return err
+	}
+	for _, suffix := range []string{".onion_key", ".onion_v3_key"} {
+		path := filepath.Join(absPath, id+suffix)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseAddOnionPrivateKey extracts PrivateKey=... from an ADD_ONION
+// reply to a NEW: key request.
+func parseAddOnionPrivateKey(resp *bulb.Response) (string, error) {
+	if v, ok := addOnionReplyField(resp, "PrivateKey="); ok {
+		return v, nil
+	}
+	return "", fmt.Errorf("ADD_ONION response missing PrivateKey: %v", resp.Data)
+}
@@ -12,19 +12,52 @@ import (
 	mafmt "github.com/whyrusleeping/mafmt"
 	"github.com/yawning/bulb"
 	"github.com/yawning/bulb/utils/pkcs1"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/sha3"
 	"golang.org/x/net/proxy"
 
+	"bytes"
 	"context"
 	"crypto/rsa"
 	"encoding/base32"
 	"encoding/pem"
 	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 )
 
+// KeyType selects which kind of onion service key material Listen
+// asks Tor to generate for a "/onion/new:PORT" address.
+type KeyType int
+
+const (
+	// KeyTypeV2 generates legacy RSA-1024 (16-char) onion keys.
+	KeyTypeV2 KeyType = iota
+	// KeyTypeV3 generates next-gen ed25519 (56-char) onion keys.
+	KeyTypeV3
+)
+
+// v3PubKeyLen, v3ChecksumLen and v3Version are the field widths of a
+// decoded Tor v3 onion address: pubkey || checksum || version.
+const (
+	v3PubKeyLen   = ed25519.PublicKeySize
+	v3ChecksumLen = 2
+	v3Version     = 0x03
+)
+
+// onionChecksumV3 computes the two-byte checksum Tor appends to a v3
+// onion address, per rend-spec-v3: SHA3-256(".onion checksum" || pubkey || version)[:2]
+func onionChecksumV3(pubkey []byte) []byte {
+	h := sha3.New256()
+	h.Write([]byte(".onion checksum"))
+	h.Write(pubkey)
+	h.Write([]byte{v3Version})
+	return h.Sum(nil)[:v3ChecksumLen]
+}
+
 // IsValidOnionMultiAddr is used to validate that a multiaddr
 // is representing a Tor onion service
 func IsValidOnionMultiAddr(a ma.Multiaddr) bool {
@@ -47,13 +80,31 @@ func IsValidOnionMultiAddr(a ma.Multiaddr) bool {
 		return false
 	}
 
-	// onion address without the ".onion" substring
-	if len(split[0]) != 16 {
-		fmt.Println(split[0])
-		return false
-	}
-	_, err = base32.StdEncoding.DecodeString(strings.ToUpper(split[0]))
-	if err != nil {
+	// onion address without the ".onion" substring: 16 chars for a v2
+	// (RSA1024) service, 56 chars for a v3 (ed25519) service
+	switch len(split[0]) {
+	case 16:
+		if _, err := base32.StdEncoding.DecodeString(strings.ToUpper(split[0])); err != nil {
+			return false
+		}
+	case 56:
+		decoded, err := base32.StdEncoding.DecodeString(strings.ToUpper(split[0]))
+		if err != nil {
+			return false
+		}
+		if len(decoded) != v3PubKeyLen+v3ChecksumLen+1 {
+			return false
+		}
+		pubkey := decoded[:v3PubKeyLen]
+		checksum := decoded[v3PubKeyLen : v3PubKeyLen+v3ChecksumLen]
+		version := decoded[v3PubKeyLen+v3ChecksumLen]
+		if version != v3Version {
+			return false
+		}
+		if !bytes.Equal(checksum, onionChecksumV3(pubkey)) {
+			return false
+		}
+	default:
 		return false
 	}
 
@@ -72,11 +123,40 @@ func IsValidOnionMultiAddr(a ma.Multiaddr) bool {
 // OnionTransport implements go-libp2p-transport's Transport interface
 type OnionTransport struct {
 	controlConn *bulb.Conn
+	// controlNet, controlAddr and controlPass are kept so the Events
+	// subsystem can open its own, second control connection.
+	controlNet  string
+	controlAddr string
+	controlPass string
 	auth        *proxy.Auth
 	keysDir     string
 	keys        map[string]*rsa.PrivateKey
+	keysV3      map[string]ed25519.PrivateKey
+	keyType     KeyType
 	onlyOnion   bool
 	upgrader    *tptu.Upgrader
+	services    map[string]*onionService
+
+	// nonAnonymous brings services up in Tor's single-hop mode
+	// (HiddenServiceSingleHopMode + HiddenServiceNonAnonymousMode), which
+	// gives up client-side anonymity in exchange for lower latency.
+	nonAnonymous bool
+	// maxStreams caps the number of streams a single rendezvous circuit
+	// may carry before Tor closes it, 0 meaning no cap.
+	maxStreams int
+
+	// clientAuths holds inbound client-authorization credentials, keyed
+	// by onion ID, that we ask Tor to enforce on our own services.
+	clientAuths map[string][]string
+	// hidServAuth holds outbound credentials for authorized services
+	// other operators expose to us, keyed by onion ID.
+	hidServAuth map[string]string
+
+	// eventConn is the second control connection StartEvents opens for
+	// SETEVENTS, kept separate from controlConn so the dialer/listener
+	// control traffic isn't interleaved with async event delivery.
+	eventConn *bulb.Conn
+	eventsCh  chan TorEvent
 }
 
 // Dial initializes a new connection to a peer at a given address
@@ -145,8 +225,21 @@ func (t *OnionTransport) Proxy() bool {
 // auth contains the socks proxy username and password
 // keysDir is the key material for the Tor onion service.
 //
+// keyType controls which kind of key (v2 RSA or v3 ed25519) Listen
+// generates for a "/onion/new:PORT" address; listening on a named address
+// whose key material isn't on disk returns an error.
+//
 // if onlyOnion is true the dialer will only be used to dial out on onion addresses
-func NewOnionTransport(controlNet, controlAddr, controlPass string, auth *proxy.Auth, keysDir string, upgrader *tptu.Upgrader, onlyOnion bool) (*OnionTransport, error) {
+//
+// nonAnonymous brings every service this transport listens on up in Tor's
+// single-hop mode, cutting rendezvous latency roughly 3x at the cost of
+// client-side anonymity for the service itself; it requires
+// HiddenServiceSingleHopMode 1 and HiddenServiceNonAnonymousMode 1 in
+// torrc, and since it's easy to flip on by accident, NewOnionTransport
+// logs a warning whenever it's true. maxStreams caps the number of
+// streams Tor will allow per rendezvous circuit before closing it (0
+// means unlimited).
+func NewOnionTransport(controlNet, controlAddr, controlPass string, auth *proxy.Auth, keysDir string, upgrader *tptu.Upgrader, onlyOnion bool, keyType KeyType, nonAnonymous bool, maxStreams int) (*OnionTransport, error) {
 	conn, err := bulb.Dial(controlNet, controlAddr)
 	if err != nil {
 		return nil, err
@@ -154,18 +247,35 @@ func NewOnionTransport(controlNet, controlAddr, controlPass string, auth *proxy.
 	if err := conn.Authenticate(controlPass); err != nil {
 		return nil, fmt.Errorf("Authentication failed: %v", err)
 	}
+	if nonAnonymous {
+		log.Printf("go-onion-transport: NonAnonymous is set; services will run in Tor single-hop mode with no client-side anonymity")
+	}
 	o := OnionTransport{
-		controlConn: conn,
-		auth:        auth,
-		keysDir:     keysDir,
-		onlyOnion:   onlyOnion,
-		upgrader:    upgrader,
+		controlConn:  conn,
+		controlNet:   controlNet,
+		controlAddr:  controlAddr,
+		controlPass:  controlPass,
+		auth:         auth,
+		keysDir:      keysDir,
+		onlyOnion:    onlyOnion,
+		upgrader:     upgrader,
+		keyType:      keyType,
+		services:     make(map[string]*onionService),
+		nonAnonymous: nonAnonymous,
+		maxStreams:   maxStreams,
+		clientAuths:  make(map[string][]string),
+		hidServAuth:  make(map[string]string),
 	}
 	keys, err := o.loadKeys()
 	if err != nil {
 		return nil, err
 	}
 	o.keys = keys
+	keysV3, err := o.loadKeysV3()
+	if err != nil {
+		return nil, err
+	}
+	o.keysV3 = keysV3
 	return &o, nil
 }
 
@@ -175,9 +285,9 @@ type OnionTransportC func(*tptu.Upgrader) (tpt.Transport, error)
 
 // NewOnionTransportC is a convenience function that returns a function
 // suitable for passing into libp2p.Transport for host configuration
-func NewOnionTransportC(controlNet, controlAddr, controlPass string, auth *proxy.Auth, keysDir string, onlyOnion bool) OnionTransportC {
+func NewOnionTransportC(controlNet, controlAddr, controlPass string, auth *proxy.Auth, keysDir string, onlyOnion bool, keyType KeyType, nonAnonymous bool, maxStreams int) OnionTransportC {
 	return func(upgrader *tptu.Upgrader) (tpt.Transport, error) {
-		return NewOnionTransport(controlNet, controlAddr, controlPass, auth, keysDir, upgrader, onlyOnion)
+		return NewOnionTransport(controlNet, controlAddr, controlPass, auth, keysDir, upgrader, onlyOnion, keyType, nonAnonymous, maxStreams)
 	}
 }
 
@@ -225,6 +335,48 @@ func (t *OnionTransport) loadKeys() (map[string]*rsa.PrivateKey, error) {
 	return keys, err
 }
 
+// v3KeyMagic is the header Tor writes at the start of an
+// `== ed25519v1-secret: type0 ==` hidden service key file.
+var v3KeyMagic = []byte("== ed25519v1-secret: type0 ==\000\000\000")
+
+// loadKeysV3 loads v3 (ed25519) keys into our keys map from files in the
+// keys directory. A key file is named <56-char-id>.onion_v3_key and holds
+// either a PEM-encoded ed25519 private key or a raw Tor
+// `== ed25519v1-secret: type0 ==` expanded secret key blob.
+func (t *OnionTransport) loadKeysV3() (map[string]ed25519.PrivateKey, error) {
+	keys := make(map[string]ed25519.PrivateKey)
+	absPath, err := filepath.Abs(t.keysDir)
+	if err != nil {
+		return nil, err
+	}
+	walkpath := func(path string, f os.FileInfo, err error) error {
+		if !strings.HasSuffix(path, ".onion_v3_key") {
+			return nil
+		}
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		onionName := strings.Replace(filepath.Base(path), ".onion_v3_key", "", 1)
+
+		var keyBytes []byte
+		if block, _ := pem.Decode(raw); block != nil {
+			keyBytes = block.Bytes
+		} else if bytes.HasPrefix(raw, v3KeyMagic) {
+			keyBytes = raw[len(v3KeyMagic):]
+		} else {
+			keyBytes = raw
+		}
+		if len(keyBytes) != ed25519.PrivateKeySize {
+			return fmt.Errorf("malformed v3 onion key for %s", onionName)
+		}
+		keys[onionName] = ed25519.PrivateKey(keyBytes)
+		return nil
+	}
+	err = filepath.Walk(absPath, walkpath)
+	return keys, err
+}
+
 // Listen creates and returns a go-libp2p-transport Listener
 func (t *OnionTransport) Listen(laddr ma.Multiaddr) (tpt.Listener, error) {
 
@@ -246,23 +398,63 @@ func (t *OnionTransport) Listen(laddr ma.Multiaddr) (tpt.Listener, error) {
 		return nil, fmt.Errorf("failed to convert onion service port to int")
 	}
 
+	// "/onion/new:PORT" asks us to generate a fresh key (of t.keyType)
+	// and persist it, rather than loading one from keysDir.
+	if addr[0] == newOnionHost {
+		return t.generateAndListen(uint16(port), laddr)
+	}
+
+	// v3 (ed25519, 56-char) addresses are looked up and brought up
+	// separately from legacy v2 (RSA1024, 16-char) addresses.
+	if len(addr[0]) == 56 {
+		return t.listenV3(addr[0], uint16(port), laddr)
+	}
+
 	onionKey, ok := t.keys[addr[0]]
 	if !ok {
 		return nil, fmt.Errorf("missing onion service key material for %s", addr[0])
 	}
 
+	id, err := pkcs1.OnionAddr(&onionKey.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to derive onion ID: %v", err)
+	}
+	keyArg, err := rsaKeyArg(onionKey)
+	if err != nil {
+		return nil, err
+	}
+
 	listener := OnionListener{
 		port:  uint16(port),
 		key:   onionKey,
 		laddr: laddr,
 	}
-
-	// setup bulb listener
-	_, err = pkcs1.OnionAddr(&onionKey.PublicKey)
+	listener.listener, err = t.addVirtPortListener(id, keyArg, uint16(port))
 	if err != nil {
-		return nil, fmt.Errorf("Failed to derive onion ID: %v", err)
+		return nil, err
 	}
-	listener.listener, err = t.controlConn.Listener(uint16(port), onionKey)
+
+	return t.upgrader.UpgradeListener(t, listener), nil
+}
+
+// listenV3 brings up a v3 (ed25519) onion service for addr, a 56-char
+// onion ID whose key was loaded from keysDir, and registers port as its
+// virtual port.
+func (t *OnionTransport) listenV3(addr string, port uint16, laddr ma.Multiaddr) (tpt.Listener, error) {
+	onionKey, ok := t.keysV3[addr]
+	if !ok {
+		return nil, fmt.Errorf("missing onion service key material for %s", addr)
+	}
+
+	listener := OnionListener{
+		port:    port,
+		keyV3:   onionKey,
+		laddr:   laddr,
+		isKeyV3: true,
+	}
+
+	var err error
+	listener.listener, err = t.addVirtPortListener(addr, ed25519KeyArg(onionKey), port)
 	if err != nil {
 		return nil, err
 	}
@@ -279,6 +471,8 @@ func (t *OnionTransport) Matches(a ma.Multiaddr) bool {
 type OnionListener struct {
 	port      uint16
 	key       *rsa.PrivateKey
+	keyV3     ed25519.PrivateKey
+	isKeyV3   bool
 	laddr     ma.Multiaddr
 	listener  net.Listener
 	transport tpt.Transport
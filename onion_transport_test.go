@@ -5,10 +5,15 @@ import (
 	ma "github.com/multiformats/go-multiaddr"
 	"crypto/rsa"
 	"github.com/yawning/bulb/utils/pkcs1"
+	"golang.org/x/crypto/ed25519"
+	"encoding/base32"
 	"os"
 	"encoding/pem"
 	"crypto/rand"
+	"io/ioutil"
 	"path"
+	"path/filepath"
+	"strings"
 )
 
 var key string
@@ -48,6 +53,86 @@ func TestIsValidOnionMultiAddr(t *testing.T) {
 	if valid {
 		t.Fatal("IsValidMultiAddr failed")
 	}
+
+	// Test valid v3
+	v3Host, err := createV3OnionHost()
+	if err != nil {
+		t.Fatal(err)
+	}
+	validV3Addr, err := ma.NewMultiaddr("/onion/" + v3Host + ":4003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsValidOnionMultiAddr(validV3Addr) {
+		t.Fatal("IsValidMultiAddr failed on a valid v3 address")
+	}
+
+	// Test v3 with a corrupted checksum: character 52 encodes bits 260-264
+	// of the decoded address, which lie inside the checksum bytes (bits
+	// 256-271), so the pubkey and version byte stay intact.
+	corrupt := "a"
+	if v3Host[52] == 'a' {
+		corrupt = "b"
+	}
+	badChecksum := v3Host[:52] + corrupt + v3Host[53:]
+	invalidV3Addr, err := ma.NewMultiaddr("/onion/" + badChecksum + ":4003")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if IsValidOnionMultiAddr(invalidV3Addr) {
+		t.Fatal("IsValidMultiAddr accepted a v3 address with a bad checksum")
+	}
+}
+
+// createV3OnionHost builds a syntactically and cryptographically valid
+// v3 onion host (without the ".onion" suffix) for a freshly generated
+// ed25519 key, for use in tests.
+func createV3OnionHost() (string, error) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	checksum := onionChecksumV3(pub)
+	decoded := append(append([]byte{}, pub...), checksum...)
+	decoded = append(decoded, 0x03)
+	return strings.ToLower(base32.StdEncoding.EncodeToString(decoded)), nil
+}
+
+// TestLoadKeysV3ParsesRawTorKeyFile checks that loadKeysV3 correctly
+// strips Tor's real 32-byte `== ed25519v1-secret: type0 ==` header
+// (29 text bytes + 3 NUL padding bytes), not just a PEM-encoded key.
+func TestLoadKeysV3ParsesRawTorKeyFile(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "onion-v3-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	raw := append(append([]byte{}, v3KeyMagic...), priv...)
+	if err := ioutil.WriteFile(filepath.Join(dir, "id.onion_v3_key"), raw, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	transport := &OnionTransport{keysDir: dir}
+	keys, err := transport.loadKeysV3()
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, ok := keys["id"]
+	if !ok {
+		t.Fatal("loadKeysV3 did not load the key written with Tor's on-disk header")
+	}
+	if len(loaded) != ed25519.PrivateKeySize {
+		t.Fatalf("expected a %d-byte key, got %d", ed25519.PrivateKeySize, len(loaded))
+	}
+	if string(loaded) != string(priv) {
+		t.Fatal("loaded key does not match the key that was written")
+	}
 }
 
 func createHiddenServiceKey() (string, error){
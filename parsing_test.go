@@ -0,0 +1,45 @@
+package torOnion
+
+import (
+	"testing"
+
+	"github.com/yawning/bulb"
+)
+
+func TestParseAddOnionServiceID(t *testing.T) {
+	resp := &bulb.Response{Data: []string{
+		"ServiceID=erhkddypoy6qml6h",
+		"PrivateKey=RSA1024:AAAA",
+	}}
+
+	id, err := parseAddOnionServiceID(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "erhkddypoy6qml6h" {
+		t.Fatalf("expected erhkddypoy6qml6h, got %q", id)
+	}
+}
+
+func TestParseAddOnionPrivateKey(t *testing.T) {
+	resp := &bulb.Response{Data: []string{
+		"ServiceID=erhkddypoy6qml6h",
+		"PrivateKey=RSA1024:AAAA",
+	}}
+
+	key, err := parseAddOnionPrivateKey(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "RSA1024:AAAA" {
+		t.Fatalf("expected RSA1024:AAAA, got %q", key)
+	}
+}
+
+func TestParseAddOnionPrivateKeyMissing(t *testing.T) {
+	resp := &bulb.Response{Data: []string{"ServiceID=erhkddypoy6qml6h"}}
+
+	if _, err := parseAddOnionPrivateKey(resp); err == nil {
+		t.Fatal("expected an error when PrivateKey= is absent")
+	}
+}
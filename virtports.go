@@ -0,0 +1,136 @@
+package torOnion
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/yawning/bulb"
+	"github.com/yawning/bulb/utils/pkcs1"
+	"golang.org/x/crypto/ed25519"
+)
+
+// onionService tracks the live state of one ADD_ONIONed service so that
+// AddVirtPort can register another virtual port later without losing
+// the service's address: Tor requires re-issuing ADD_ONION with the
+// same key material to do that, rather than amending the live service.
+type onionService struct {
+	id    string
+	key   string   // the ADD_ONION key= argument, e.g. "RSA1024:<base64 DER>"
+	ports []string // "VIRT,TARGET" pairs already registered with Tor
+}
+
+// rsaKeyArg renders an RSA-1024 key as the ADD_ONION key= argument Tor
+// expects for an already-generated v2 service.
+func rsaKeyArg(key *rsa.PrivateKey) (string, error) {
+	der, err := pkcs1.EncodePrivateKeyDER(key)
+	if err != nil {
+		return "", err
+	}
+	return "RSA1024:" + base64.StdEncoding.EncodeToString(der), nil
+}
+
+// ed25519KeyArg renders an ed25519 key as the ADD_ONION key= argument
+// Tor expects for an already-generated v3 service.
+func ed25519KeyArg(key ed25519.PrivateKey) string {
+	return "ED25519-V3:" + base64.StdEncoding.EncodeToString(key)
+}
+
+// addVirtPortListener binds a local TCP listener on an ephemeral port
+// and registers it with Tor as the TARGET for virt on the onion service
+// id, issuing ADD_ONION with keyArg. If id already has a service, the
+// virtual port is added to it by re-issuing ADD_ONION with the same key
+// and the full set of ports the service already has.
+func (t *OnionTransport) addVirtPortListener(id, keyArg string, virt uint16) (net.Listener, error) {
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	target := local.Addr().(*net.TCPAddr).Port
+	portArg := fmt.Sprintf("%d,127.0.0.1:%d", virt, target)
+
+	svc, exists := t.services[id]
+	if !exists {
+		svc = &onionService{id: id, key: keyArg}
+	} else if _, err := t.controlConn.Request("DEL_ONION " + svc.id); err != nil {
+		local.Close()
+		return nil, fmt.Errorf("failed to detach %s to add a virtual port: %v", id, err)
+	}
+	ports := append(append([]string{}, svc.ports...), portArg)
+
+	var flags []string
+	if t.nonAnonymous {
+		flags = append(flags, "NonAnonymous")
+	}
+	resp, err := t.controlConn.Request("%s", addOnionCommand(keyArg, ports, flags, t.maxStreams, t.clientAuthArgs(id)))
+	if err != nil {
+		local.Close()
+		return nil, err
+	}
+	serviceID, err := parseAddOnionServiceID(resp)
+	if err != nil {
+		local.Close()
+		return nil, err
+	}
+
+	svc.id = serviceID
+	svc.ports = ports
+	t.services[serviceID] = svc
+
+	return local, nil
+}
+
+// AddVirtPort adds an additional virtual port to an onion service that's
+// already listening, reusing its existing key so the .onion address
+// doesn't change. This lets one .onion multiplex libp2p on one port and,
+// say, a plain HTTP admin interface on another.
+func (t *OnionTransport) AddVirtPort(onionID string, virt uint16) (net.Listener, error) {
+	svc, ok := t.services[onionID]
+	if !ok {
+		return nil, fmt.Errorf("no active onion service for %s", onionID)
+	}
+	return t.addVirtPortListener(onionID, svc.key, virt)
+}
+
+// addOnionCommand builds the ADD_ONION control command for keyArg with
+// one Port=VIRT,TARGET argument per entry in ports, the given service
+// flags (e.g. "NonAnonymous"), a MaxStreams cap when maxStreams > 0, and
+// any extra verbatim arguments (e.g. "ClientAuth=alice:cookie").
+func addOnionCommand(keyArg string, ports []string, flags []string, maxStreams int, extraArgs []string) string {
+	parts := make([]string, 0, len(ports)+len(extraArgs)+4)
+	parts = append(parts, "ADD_ONION", keyArg)
+	for _, p := range ports {
+		parts = append(parts, "Port="+p)
+	}
+	if maxStreams > 0 {
+		parts = append(parts, fmt.Sprintf("MaxStreams=%d", maxStreams))
+		flags = append(flags, "MaxStreamsCloseCircuit")
+	}
+	if len(flags) > 0 {
+		parts = append(parts, "Flags="+strings.Join(flags, ","))
+	}
+	parts = append(parts, extraArgs...)
+	return strings.Join(parts, " ")
+}
+
+// addOnionReplyField returns the value of the first line in resp.Data
+// that starts with key (e.g. "ServiceID="), reading bulb's already
+// split reply lines rather than re-parsing a stringified response.
+func addOnionReplyField(resp *bulb.Response, key string) (string, bool) {
+	for _, line := range resp.Data {
+		if strings.HasPrefix(line, key) {
+			return strings.TrimPrefix(line, key), true
+		}
+	}
+	return "", false
+}
+
+// parseAddOnionServiceID extracts ServiceID=... from an ADD_ONION reply.
+func parseAddOnionServiceID(resp *bulb.Response) (string, error) {
+	if v, ok := addOnionReplyField(resp, "ServiceID="); ok {
+		return v, nil
+	}
+	return "", fmt.Errorf("ADD_ONION response missing ServiceID: %v", resp.Data)
+}
@@ -0,0 +1,27 @@
+package torOnion
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAddOnionCommand(t *testing.T) {
+	cmd := addOnionCommand("RSA1024:AAAA", []string{"80,127.0.0.1:9001"}, nil, 4, nil)
+
+	if !strings.Contains(cmd, "MaxStreams=4") {
+		t.Fatalf("expected a MaxStreams argument, got %q", cmd)
+	}
+	if !strings.Contains(cmd, "Flags=MaxStreamsCloseCircuit") {
+		t.Fatalf("expected MaxStreamsCloseCircuit to be folded into Flags=, got %q", cmd)
+	}
+	for _, arg := range strings.Fields(cmd) {
+		if arg == "MaxStreamsCloseCircuit" {
+			t.Fatalf("MaxStreamsCloseCircuit must not appear as a bare argument, got %q", cmd)
+		}
+	}
+
+	cmd = addOnionCommand("RSA1024:AAAA", []string{"80,127.0.0.1:9001"}, []string{"NonAnonymous"}, 4, nil)
+	if !strings.Contains(cmd, "Flags=NonAnonymous,MaxStreamsCloseCircuit") {
+		t.Fatalf("expected NonAnonymous and MaxStreamsCloseCircuit to share one Flags= list, got %q", cmd)
+	}
+}